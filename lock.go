@@ -1,7 +1,9 @@
 package restic
 
 import (
+	"context"
 	"errors"
+	mrand "math/rand"
 	"os"
 	"os/signal"
 	"os/user"
@@ -29,37 +31,243 @@ type Lock struct {
 	UID       uint32    `json:"uid,omitempty"`
 	GID       uint32    `json:"gid,omitempty"`
 
+	// Epoch is the fencing token obtained when this lock was created, see
+	// CurrentEpoch and CheckFence.
+	Epoch uint64 `json:"epoch,omitempty"`
+
+	// EpochMarker, when non-zero, means this blob is a persisted epoch
+	// counter entry written by nextEpoch, not an actual lock. Every
+	// exclusive lock acquisition writes one of these alongside its own
+	// lock file. Markers are never touched by RemoveStaleLocks, Unlock or
+	// BreakLock, which is what keeps CurrentEpoch monotonic even after the
+	// lock that requested an epoch is long gone; nextEpoch itself compacts
+	// the marker(s) it supersedes once a new one is durable, so at most one
+	// is normally left lying around rather than one per exclusive lock ever
+	// taken.
+	EpochMarker uint64 `json:"epoch_marker,omitempty"`
+
+	// Checker selects the StalenessPolicy used to decide whether this lock
+	// is stale, see Stale. It is recorded on the lock itself so that any
+	// process inspecting the lock, not just the one that created it,
+	// applies the same policy.
+	Checker StalenessPolicy `json:"staleness_policy,omitempty"`
+
+	// StaleTimeout and RefreshInterval default to DefaultStaleTimeout and
+	// DefaultRefreshInterval respectively, but can be overridden per
+	// repository so that slow backends don't have to live with the global
+	// default.
+	StaleTimeout    time.Duration `json:"stale_timeout,omitempty"`
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+
 	repo   *repository.Repository
+	mu     sync.Mutex
 	lockID backend.ID
+
+	refreshStop chan struct{}
+	refreshDone chan struct{}
 }
 
 var (
 	ErrAlreadyLocked  = errors.New("already locked")
 	ErrStaleLockFound = errors.New("stale lock found")
+
+	// ErrLockEpochStale is returned by Lock.CheckFence when a newer
+	// exclusive lock has been acquired since the lock was created, meaning
+	// the lock's fencing token (Epoch) is no longer current.
+	ErrLockEpochStale = errors.New("lock epoch is stale, a newer exclusive lock has since been acquired")
+
+	// ErrLockSuperseded is returned by Lock.Refresh when another exclusive
+	// lock already exists in the repository, meaning this lock was
+	// presumably judged stale and removed while its owner kept running.
+	// Refresh refuses to write the lock back in that case.
+	ErrLockSuperseded = errors.New("lock was superseded by another process, refusing to refresh")
 )
 
 // NewLock returns a new, non-exclusive lock for the repository. If an
 // exclusive lock is already held by another process, ErrAlreadyLocked is
 // returned.
 func NewLock(repo *repository.Repository) (*Lock, error) {
-	return newLock(repo, false)
+	return newLock(repo, false, LockOptions{})
 }
 
 // NewExclusiveLock returns a new, exclusive lock for the repository. If
 // another lock (normal and exclusive) is already held by another process,
 // ErrAlreadyLocked is returned.
 func NewExclusiveLock(repo *repository.Repository) (*Lock, error) {
-	return newLock(repo, true)
+	return newLock(repo, true, LockOptions{})
+}
+
+// LockOptions overrides the defaults a Lock is created with. Zero-valued
+// fields fall back to the package defaults (DefaultStalenessPolicy,
+// DefaultStaleTimeout, DefaultRefreshInterval), so repositories on slow
+// backends can widen these per-repository instead of every caller living
+// with the global default.
+type LockOptions struct {
+	// StalenessPolicy is recorded as the lock's StalenessChecker.
+	StalenessPolicy StalenessPolicy
+	// StaleTimeout is how long before Stale() considers the lock stale.
+	StaleTimeout time.Duration
+	// RefreshInterval is how often StartRefresh rewrites the lock file.
+	RefreshInterval time.Duration
+}
+
+// NewLockWithOptions is like NewLock, but allows overriding the lock's
+// StalenessPolicy, StaleTimeout and RefreshInterval instead of living with
+// the package defaults.
+func NewLockWithOptions(repo *repository.Repository, opts LockOptions) (*Lock, error) {
+	return newLock(repo, false, opts)
+}
+
+// NewExclusiveLockWithOptions is the exclusive-lock counterpart of
+// NewLockWithOptions.
+func NewExclusiveLockWithOptions(repo *repository.Repository, opts LockOptions) (*Lock, error) {
+	return newLock(repo, true, opts)
+}
+
+// NewLockWithPolicy is like NewLock, but records policy as the
+// StalenessChecker the lock uses, instead of DefaultStalenessPolicy. Use
+// StalenessPolicyBeacon for repositories shared across hosts, where a
+// same-host process probe can never tell whether the owner is alive.
+func NewLockWithPolicy(repo *repository.Repository, policy StalenessPolicy) (*Lock, error) {
+	return newLock(repo, false, LockOptions{StalenessPolicy: policy})
+}
+
+// NewExclusiveLockWithPolicy is the exclusive-lock counterpart of
+// NewLockWithPolicy.
+func NewExclusiveLockWithPolicy(repo *repository.Repository, policy StalenessPolicy) (*Lock, error) {
+	return newLock(repo, true, LockOptions{StalenessPolicy: policy})
+}
+
+// LockRetryOptions controls how NewLockWithContext and
+// NewExclusiveLockWithContext wait for a conflicting lock to disappear.
+type LockRetryOptions struct {
+	// MaxWait bounds how long to wait for the lock overall. Zero means wait
+	// until ctx is done.
+	MaxWait time.Duration
+	// InitialBackoff is the wait before the first retry. Zero uses
+	// DefaultLockRetryOptions.InitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff between retries. Zero uses
+	// DefaultLockRetryOptions.MaxBackoff.
+	MaxBackoff time.Duration
+	// OnRetry, if set, is called before each wait with the hostname,
+	// username and PID of the process holding the conflicting lock, so
+	// callers can print something like "waiting for lock held by
+	// alice@host2 (pid 1234)...".
+	OnRetry func(hostname, username string, pid int)
+	// LockOptions overrides the lock's StalenessPolicy, StaleTimeout and
+	// RefreshInterval; see LockOptions.
+	LockOptions
+}
+
+// DefaultLockRetryOptions is used for zero-valued fields of
+// LockRetryOptions.
+var DefaultLockRetryOptions = LockRetryOptions{
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// NewLockWithContext returns a new, non-exclusive lock for the repository,
+// waiting with exponential backoff for a conflicting exclusive lock to
+// disappear instead of failing immediately. It returns ctx.Err() if ctx is
+// done, or ErrAlreadyLocked once opts.MaxWait elapses, before a lock is
+// obtained.
+func NewLockWithContext(ctx context.Context, repo *repository.Repository, opts LockRetryOptions) (*Lock, error) {
+	return newLockWithContext(ctx, repo, false, opts)
+}
+
+// NewExclusiveLockWithContext is the exclusive-lock counterpart of
+// NewLockWithContext.
+func NewExclusiveLockWithContext(ctx context.Context, repo *repository.Repository, opts LockRetryOptions) (*Lock, error) {
+	return newLockWithContext(ctx, repo, true, opts)
 }
 
 const waitBeforeLockCheck = 200 * time.Millisecond
 
-func newLock(repo *repository.Repository, excl bool) (*Lock, error) {
-	lock := &Lock{
-		Time:      time.Now(),
-		PID:       os.Getpid(),
-		Exclusive: excl,
-		repo:      repo,
+func newLock(repo *repository.Repository, excl bool, opts LockOptions) (*Lock, error) {
+	lock, _, err := tryLock(repo, excl, opts)
+	return lock, err
+}
+
+func newLockWithContext(ctx context.Context, repo *repository.Repository, excl bool, opts LockRetryOptions) (*Lock, error) {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultLockRetryOptions.InitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultLockRetryOptions.MaxBackoff
+	}
+
+	var maxWait <-chan time.Time
+	if opts.MaxWait > 0 {
+		timer := time.NewTimer(opts.MaxWait)
+		defer timer.Stop()
+		maxWait = timer.C
+	}
+
+	backoff := opts.InitialBackoff
+	for {
+		lock, conflict, err := tryLock(repo, excl, opts.LockOptions)
+		if err == nil {
+			return lock, nil
+		}
+		if err != ErrAlreadyLocked {
+			return nil, err
+		}
+
+		if opts.OnRetry != nil && conflict != nil {
+			opts.OnRetry(conflict.Hostname, conflict.Username, conflict.PID)
+		}
+
+		wait := jitter(backoff)
+		backoff *= 2
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-maxWait:
+			return nil, ErrAlreadyLocked
+		case <-time.After(wait):
+		}
+	}
+}
+
+// jitter returns a duration in [d/2, d], so that many processes backing off
+// after losing a race for the same lock don't retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(mrand.Int63n(int64(d)/2+1))
+}
+
+// tryLock makes a single attempt at acquiring a lock, using the same
+// double-check pattern as the original newLock: create the lock file, wait
+// waitBeforeLockCheck, then check again for conflicts that appeared in the
+// meantime. On ErrAlreadyLocked it also returns the conflicting lock found,
+// if any, so callers retrying can report who holds it.
+func tryLock(repo *repository.Repository, excl bool, opts LockOptions) (lock *Lock, conflict *Lock, err error) {
+	if opts.StalenessPolicy == "" {
+		opts.StalenessPolicy = DefaultStalenessPolicy
+	}
+	if opts.StaleTimeout <= 0 {
+		opts.StaleTimeout = DefaultStaleTimeout
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = DefaultRefreshInterval
+	}
+
+	lock = &Lock{
+		Time:            time.Now(),
+		PID:             os.Getpid(),
+		Exclusive:       excl,
+		repo:            repo,
+		StaleTimeout:    opts.StaleTimeout,
+		RefreshInterval: opts.RefreshInterval,
+		Checker:         opts.StalenessPolicy,
 	}
 
 	hn, err := os.Hostname()
@@ -68,26 +276,33 @@ func newLock(repo *repository.Repository, excl bool) (*Lock, error) {
 	}
 
 	if err = lock.fillUserInfo(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if err = lock.checkForOtherLocks(); err != nil {
-		return nil, err
+	if conflict, err = conflictingLock(repo, lock); err != nil {
+		return nil, conflict, err
 	}
 
-	err = lock.createLock()
-	if err != nil {
-		return nil, err
+	if excl {
+		epoch, err := nextEpoch(repo)
+		if err != nil {
+			return nil, nil, err
+		}
+		lock.Epoch = epoch
+	}
+
+	if err = lock.createLock(); err != nil {
+		return nil, nil, err
 	}
 
 	time.Sleep(waitBeforeLockCheck)
 
-	if err = lock.checkForOtherLocks(); err != nil {
+	if conflict, err = conflictingLock(repo, lock); err != nil {
 		lock.Unlock()
-		return nil, ErrAlreadyLocked
+		return nil, conflict, err
 	}
 
-	return lock, nil
+	return lock, nil, nil
 }
 
 func (l *Lock) fillUserInfo() error {
@@ -112,14 +327,16 @@ func (l *Lock) fillUserInfo() error {
 	return nil
 }
 
-// checkForOtherLocks looks for other locks that currently exist in the repository.
+// conflictingLock looks for other locks that currently exist in the
+// repository which conflict with l.
 //
-// If an exclusive lock is to be created, checkForOtherLocks returns an error
-// if there are any other locks, regardless if exclusive or not. If a
-// non-exclusive lock is to be created, an error is only returned when an
-// exclusive lock is found.
-func (l *Lock) checkForOtherLocks() error {
-	return eachLock(l.repo, func(id backend.ID, lock *Lock, err error) error {
+// If l is exclusive, any other lock conflicts, regardless if exclusive or
+// not. If l is non-exclusive, only an exclusive lock conflicts. On conflict
+// it returns ErrAlreadyLocked along with the conflicting lock found.
+func conflictingLock(repo *repository.Repository, l *Lock) (*Lock, error) {
+	var conflict *Lock
+
+	err := eachLock(repo, func(id backend.ID, lock *Lock, err error) error {
 		if id.Equal(l.lockID) {
 			return nil
 		}
@@ -129,16 +346,20 @@ func (l *Lock) checkForOtherLocks() error {
 			return nil
 		}
 
-		if l.Exclusive {
-			return ErrAlreadyLocked
+		// epoch counter markers aren't locks and never conflict
+		if lock.EpochMarker != 0 {
+			return nil
 		}
 
-		if !l.Exclusive && lock.Exclusive {
+		if l.Exclusive || lock.Exclusive {
+			conflict = lock
 			return ErrAlreadyLocked
 		}
 
 		return nil
 	})
+
+	return conflict, err
 }
 
 func eachLock(repo *repository.Repository, f func(backend.ID, *Lock, error) error) error {
@@ -156,6 +377,26 @@ func eachLock(repo *repository.Repository, f func(backend.ID, *Lock, error) erro
 	return nil
 }
 
+// lockFileExists reports whether id is still present among the repository's
+// lock blobs. A nil id (a lock that was never successfully created) is
+// reported as not existing.
+func lockFileExists(repo *repository.Repository, id backend.ID) bool {
+	if id == nil {
+		return false
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for lid := range repo.List(backend.Lock, done) {
+		if lid.Equal(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // createLock acquires the lock by creating a file in the repository.
 func (l *Lock) createLock() error {
 	id, err := l.repo.SaveJSONUnpacked(backend.Lock, l)
@@ -167,41 +408,400 @@ func (l *Lock) createLock() error {
 	return nil
 }
 
+// CurrentEpoch returns the highest fencing epoch recorded in the
+// repository's persisted epoch markers (see EpochMarker). Unlike scanning
+// the currently held locks, this is independent of whether any particular
+// lock file still exists: nextEpoch compacts old markers away as it writes
+// new ones, but the highest value it has ever handed out is never among
+// them, so the value returned here never goes backwards, even after the
+// exclusive lock that requested it has been judged stale and removed.
+func CurrentEpoch(repo *repository.Repository) (uint64, error) {
+	max, _, err := currentEpochMarkers(repo)
+	return max, err
+}
+
+// currentEpochMarkers is CurrentEpoch plus the IDs of the marker blobs that
+// produced it, so nextEpoch can compact them away after writing a new one
+// instead of leaving every marker it has ever written behind forever.
+func currentEpochMarkers(repo *repository.Repository) (max uint64, ids []backend.ID, err error) {
+	err = eachLock(repo, func(id backend.ID, lock *Lock, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if lock.EpochMarker == 0 {
+			return nil
+		}
+
+		ids = append(ids, id)
+		if lock.EpochMarker > max {
+			max = lock.EpochMarker
+		}
+
+		return nil
+	})
+
+	return max, ids, err
+}
+
+// nextEpoch returns the next fencing epoch to hand out and durably records
+// it as a marker in the repository, so that CurrentEpoch keeps returning at
+// least this value even once the exclusive lock using it is gone. This is
+// what makes the epoch monotonic across the removal of a stale lock, which
+// is the exact situation fencing exists to guard against: without a
+// persisted marker, removing a stale lock makes the repository look as
+// though no lock had ever been acquired, and the next exclusive lock would
+// get epoch 1 again, exactly like the zombie writer's.
+//
+// Once the new marker is written, any markers it superseded are removed, so
+// at most one marker blob is normally left lying around rather than one per
+// exclusive lock ever taken. Removal is best-effort: a straggler left behind
+// by a failed removal is simply picked up and compacted by the next call.
+//
+// Two processes racing to acquire an exclusive lock at the same instant can
+// still read the same CurrentEpoch and hand out the same next value; a true
+// compare-and-swap counter would need support from the backend that isn't
+// available through the repository.Repository API used here.
+func nextEpoch(repo *repository.Repository) (uint64, error) {
+	current, old, err := currentEpochMarkers(repo)
+	if err != nil {
+		return 0, err
+	}
+
+	next := current + 1
+	if _, err := repo.SaveJSONUnpacked(backend.Lock, &Lock{EpochMarker: next}); err != nil {
+		return 0, err
+	}
+
+	for _, id := range old {
+		if err := repo.Backend().Remove(backend.Lock, id.String()); err != nil {
+			debug.Log("nextEpoch", "error removing superseded epoch marker %v: %v\n", id.Str(), err)
+		}
+	}
+
+	return next, nil
+}
+
+// CheckFence returns ErrLockEpochStale if a newer exclusive lock has been
+// acquired since l was created. Only exclusive locks obtain an epoch: for a
+// non-exclusive lock (Epoch 0) it returns ErrLockEpochStale as soon as any
+// exclusive lock has ever been taken in the repository.
+//
+// It only protects the lock record itself: Lock.Refresh calls it before
+// every rewrite of an exclusive lock so that a process whose lock
+// was judged stale and removed cannot write itself back into existence once
+// it wakes back up. It does not, by itself, fence any other repository
+// write (snapshots, packs, indexes) a long-running operation makes; callers
+// that keep writing to the repository across a slow or interruptible run
+// and want those writes fenced too must call CheckFence themselves before
+// each one and abort on error.
+//
+// Rejecting stale-epoch writes at the backend/repository.Repository level
+// itself, so every write is fenced automatically rather than only the ones
+// a caller remembers to check, requires plumbing Epoch through
+// SaveJSONUnpacked and the pack writers in that package, which is out of
+// reach from this file alone.
+func (l *Lock) CheckFence() error {
+	current, err := CurrentEpoch(l.repo)
+	if err != nil {
+		return err
+	}
+
+	if current > l.Epoch {
+		return ErrLockEpochStale
+	}
+
+	return nil
+}
+
+// Refresh rewrites the lock file with an updated timestamp, without
+// releasing it, and atomically swaps it in for the previous lock file. This
+// is used by StartRefresh to keep long-running operations from being judged
+// stale by other processes.
+//
+// Before rewriting, Refresh checks that it hasn't been superseded. This
+// applies to both exclusive and non-exclusive locks: if l's own lock file
+// has been removed (for instance by RemoveStaleLocks, judging this process
+// to be dead), Refresh returns ErrLockSuperseded rather than writing the
+// lock back into existence out of thin air. Exclusive locks get an
+// additional check: if another exclusive lock now exists, or this lock's
+// fencing epoch is no longer current, Refresh returns ErrLockSuperseded or
+// ErrLockEpochStale for the same reason. Without these checks, a process
+// whose lock was judged stale and removed would otherwise just write itself
+// back into existence on its next refresh tick.
+func (l *Lock) Refresh() error {
+	l.mu.Lock()
+	oldID := l.lockID
+	l.mu.Unlock()
+
+	if !lockFileExists(l.repo, oldID) {
+		return ErrLockSuperseded
+	}
+
+	if l.Exclusive {
+		err := eachLock(l.repo, func(id backend.ID, lock *Lock, err error) error {
+			if err != nil || id.Equal(oldID) || lock.EpochMarker != 0 {
+				return nil
+			}
+			if lock.Exclusive {
+				return ErrLockSuperseded
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := l.CheckFence(); err != nil {
+			return err
+		}
+	}
+
+	updated := &Lock{
+		Time:            time.Now(),
+		Exclusive:       l.Exclusive,
+		Hostname:        l.Hostname,
+		Username:        l.Username,
+		PID:             l.PID,
+		UID:             l.UID,
+		GID:             l.GID,
+		Epoch:           l.Epoch,
+		Checker:         l.Checker,
+		StaleTimeout:    l.StaleTimeout,
+		RefreshInterval: l.RefreshInterval,
+	}
+
+	id, err := l.repo.SaveJSONUnpacked(backend.Lock, updated)
+	if err != nil {
+		return err
+	}
+
+	if err = l.repo.Backend().Remove(backend.Lock, oldID.String()); err != nil {
+		debug.Log("Lock.Refresh", "error removing old lock %v: %v\n", oldID.Str(), err)
+	}
+
+	l.mu.Lock()
+	l.lockID = id
+	l.Time = updated.Time
+	l.mu.Unlock()
+
+	return nil
+}
+
+// StartRefresh starts a goroutine that periodically calls Refresh so the
+// lock does not trip the stale timeout during long backups/prunes. Errors
+// encountered while refreshing are sent on the returned channel, which is
+// closed once refreshing stops; the channel buffers one error, and an error
+// is dropped while a previous one has not been received yet. Refreshing stops when ctx is cancelled, when
+// Unlock is called, or as soon as Refresh reports that the lock has been
+// superseded (ErrLockSuperseded or ErrLockEpochStale), since retrying a lock
+// that is already gone for good would only spin forever.
+func (l *Lock) StartRefresh(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+	l.refreshStop = make(chan struct{})
+	l.refreshDone = make(chan struct{})
+
+	interval := l.RefreshInterval
+	if interval == 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	go func() {
+		defer close(errChan)
+		defer close(l.refreshDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Refresh(); err != nil {
+					debug.Log("Lock.StartRefresh", "refreshing lock failed: %v\n", err)
+					select {
+					case errChan <- err:
+					default:
+					}
+
+					if err == ErrLockSuperseded || err == ErrLockEpochStale {
+						return
+					}
+				}
+			case <-l.refreshStop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return errChan
+}
+
+// stopRefresh stops the background refresh goroutine started by
+// StartRefresh, if any, and waits for it to exit.
+func (l *Lock) stopRefresh() {
+	if l.refreshStop == nil {
+		return
+	}
+
+	close(l.refreshStop)
+	<-l.refreshDone
+	l.refreshStop = nil
+	l.refreshDone = nil
+}
+
 // Unlock removes the lock from the repository.
 func (l *Lock) Unlock() error {
-	if l == nil || l.lockID == nil {
+	if l == nil {
 		return nil
 	}
 
-	return l.repo.Backend().Remove(backend.Lock, l.lockID.String())
+	l.stopRefresh()
+
+	l.mu.Lock()
+	id := l.lockID
+	l.mu.Unlock()
+
+	if id == nil {
+		return nil
+	}
+
+	return l.repo.Backend().Remove(backend.Lock, id.String())
 }
 
-var staleTimeout = 30 * time.Minute
+var (
+	// DefaultStaleTimeout is the time after which a lock is considered
+	// stale if it hasn't been refreshed, unless overridden per-lock via
+	// Lock.StaleTimeout.
+	DefaultStaleTimeout = 30 * time.Minute
+	// DefaultRefreshInterval is how often StartRefresh rewrites the lock
+	// file, unless overridden per-lock via Lock.RefreshInterval.
+	DefaultRefreshInterval = 5 * time.Minute
+)
 
-// Stale returns true if the lock is stale. A lock is stale if the timestamp is
-// older than 30 minutes or if it was created on the current machine and the
-// process isn't alive any more.
-func (l *Lock) Stale() bool {
-	debug.Log("Lock.Stale", "testing if lock %v for process %d is stale", l.lockID.Str(), l.PID)
-	if time.Now().Sub(l.Time) > staleTimeout {
-		debug.Log("Lock.Stale", "lock is stale, timestamp is too old: %v\n", l.Time)
-		return true
+// StalenessPolicy selects how Lock.Stale decides whether the owner of a lock
+// is still alive while the lock's timestamp is still within the stale
+// timeout window; a lock past that window is stale under every policy.
+type StalenessPolicy string
+
+const (
+	// StalenessPolicySameHost probes the owning process with a signal when
+	// the lock was created on the current host (the original behavior).
+	// For a lock created on another host it cannot probe anything, so it
+	// defers to the timestamp check alone.
+	StalenessPolicySameHost StalenessPolicy = "same-host"
+
+	// StalenessPolicyBeacon treats the lock's Time field as a liveness
+	// beacon that the owning process refreshes periodically (see
+	// Lock.StartRefresh), and considers the lock stale once it hasn't been
+	// refreshed for a few refresh intervals. This is the policy to use for
+	// locks that may be owned by a different host.
+	StalenessPolicyBeacon StalenessPolicy = "beacon"
+
+	// StalenessPolicyTimestamp trusts the lock's timestamp only: a lock is
+	// stale exactly when it is older than the stale timeout, regardless of
+	// host or whether the owning process is still running.
+	StalenessPolicyTimestamp StalenessPolicy = "timestamp"
+
+	// DefaultStalenessPolicy is used for locks that don't set Checker
+	// explicitly.
+	DefaultStalenessPolicy = StalenessPolicySameHost
+)
+
+// StalenessChecker decides whether a lock whose timestamp is still within
+// the stale timeout should nonetheless be considered stale.
+type StalenessChecker interface {
+	Stale(l *Lock) bool
+}
+
+var stalenessCheckers = map[StalenessPolicy]StalenessChecker{
+	StalenessPolicySameHost:  sameHostStalenessChecker{},
+	StalenessPolicyBeacon:    beaconStalenessChecker{},
+	StalenessPolicyTimestamp: timestampStalenessChecker{},
+}
+
+// sameHostStalenessChecker implements StalenessPolicySameHost.
+type sameHostStalenessChecker struct{}
+
+func (sameHostStalenessChecker) Stale(l *Lock) bool {
+	hn, err := os.Hostname()
+	if err != nil || hn != l.Hostname {
+		debug.Log("Lock.Stale", "lock %v was created on a different host, cannot probe its process\n", l.lockID.Str())
+		return false
 	}
 
 	proc, err := os.FindProcess(l.PID)
-	defer proc.Release()
 	if err != nil {
 		debug.Log("Lock.Stale", "error searching for process %d: %v\n", l.PID, err)
 		return true
 	}
+	defer proc.Release()
 
 	debug.Log("Lock.Stale", "sending SIGHUP to process %d\n", l.PID)
-	err = proc.Signal(syscall.SIGHUP)
-	if err != nil {
+	if err = proc.Signal(syscall.SIGHUP); err != nil {
 		debug.Log("Lock.Stale", "signal error: %v, lock is probably stale\n", err)
 		return true
 	}
 
+	return false
+}
+
+// beaconStalenessChecker implements StalenessPolicyBeacon: it trusts that
+// the owning process calls Lock.Refresh every RefreshInterval, and declares
+// the lock stale once several intervals have passed without a refresh.
+type beaconStalenessChecker struct{}
+
+func (beaconStalenessChecker) Stale(l *Lock) bool {
+	interval := l.RefreshInterval
+	if interval == 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	return time.Now().Sub(l.Time) > 3*interval
+}
+
+// timestampStalenessChecker implements StalenessPolicyTimestamp. The
+// timestamp has already been checked against the stale timeout by the time
+// Stale calls into a checker, so there is nothing left to verify.
+type timestampStalenessChecker struct{}
+
+func (timestampStalenessChecker) Stale(l *Lock) bool {
+	return false
+}
+
+// checker returns the StalenessChecker this lock was recorded to use,
+// falling back to DefaultStalenessPolicy for locks that predate this field
+// or didn't set it.
+func (l *Lock) checker() StalenessChecker {
+	if c, ok := stalenessCheckers[l.Checker]; ok {
+		return c
+	}
+
+	return stalenessCheckers[DefaultStalenessPolicy]
+}
+
+// Stale returns true if the lock is stale. A lock is stale if the timestamp
+// is older than the configured stale timeout (30 minutes by default), or if
+// its StalenessChecker determines that the owner is no longer alive.
+func (l *Lock) Stale() bool {
+	debug.Log("Lock.Stale", "testing if lock %v for process %d is stale", l.lockID.Str(), l.PID)
+
+	timeout := l.StaleTimeout
+	if timeout == 0 {
+		timeout = DefaultStaleTimeout
+	}
+
+	if time.Now().Sub(l.Time) > timeout {
+		debug.Log("Lock.Stale", "lock is stale, timestamp is too old: %v\n", l.Time)
+		return true
+	}
+
+	if l.checker().Stale(l) {
+		debug.Log("Lock.Stale", "lock is stale according to %v policy\n", l.Checker)
+		return true
+	}
+
 	debug.Log("Lock.Stale", "lock not stale\n")
 	return false
 }
@@ -240,6 +840,11 @@ func RemoveStaleLocks(repo *repository.Repository) error {
 			return nil
 		}
 
+		// epoch counter markers are never stale, see EpochMarker
+		if lock.EpochMarker != 0 {
+			return nil
+		}
+
 		if lock.Stale() {
 			return repo.Backend().Remove(backend.Lock, id.String())
 		}
@@ -247,3 +852,31 @@ func RemoveStaleLocks(repo *repository.Repository) error {
 		return nil
 	})
 }
+
+// BreakLock removes every lock in the repository held by the given hostname
+// and PID, regardless of whether Stale() considers it stale.
+//
+// This is deliberately only the library-level primitive, alongside
+// NewLockWithPolicy/NewExclusiveLockWithPolicy for selecting a
+// StalenessPolicy. Actual CLI flags (e.g. --force-unlock host:pid and
+// --staleness-policy) are NOT implemented as part of this change: they
+// would live in the cmd/restic package, which does not exist in this tree.
+func BreakLock(repo *repository.Repository, hostname string, pid int) error {
+	return eachLock(repo, func(id backend.ID, lock *Lock, err error) error {
+		// ignore locks that cannot be loaded
+		if err != nil {
+			return nil
+		}
+
+		// epoch counter markers are never locks, see EpochMarker
+		if lock.EpochMarker != 0 {
+			return nil
+		}
+
+		if lock.Hostname == hostname && lock.PID == pid {
+			return repo.Backend().Remove(backend.Lock, id.String())
+		}
+
+		return nil
+	})
+}
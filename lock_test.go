@@ -0,0 +1,233 @@
+package restic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/backend"
+	"github.com/restic/restic/repository"
+)
+
+// TestLockZombieWriterFencing simulates the scenario fencing exists to
+// prevent: process A acquires an exclusive lock, stalls long enough for
+// another process to judge it stale and remove it, and only wakes back up
+// afterwards. Even though the stale-lock scan no longer sees any trace of
+// A's lock file once it has been removed, A's fencing epoch must still be
+// recognized as stale once process B has taken over.
+func TestLockZombieWriterFencing(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	lockA, err := NewExclusiveLock(repo)
+	if err != nil {
+		t.Fatalf("NewExclusiveLock for A failed: %v", err)
+	}
+
+	if lockA.Epoch != 1 {
+		t.Fatalf("expected A to get epoch 1, got %d", lockA.Epoch)
+	}
+
+	// Simulate A stalling long enough to be judged stale: replace its lock
+	// file with a back-dated copy, without going through Refresh.
+	lockA.mu.Lock()
+	oldID := lockA.lockID
+	lockA.mu.Unlock()
+
+	stale := &Lock{
+		Time:            time.Now().Add(-2 * DefaultStaleTimeout),
+		Exclusive:       lockA.Exclusive,
+		Hostname:        lockA.Hostname,
+		Username:        lockA.Username,
+		PID:             lockA.PID,
+		UID:             lockA.UID,
+		GID:             lockA.GID,
+		Epoch:           lockA.Epoch,
+		Checker:         lockA.Checker,
+		StaleTimeout:    lockA.StaleTimeout,
+		RefreshInterval: lockA.RefreshInterval,
+	}
+
+	if _, err = repo.SaveJSONUnpacked(backend.Lock, stale); err != nil {
+		t.Fatalf("failed to write back-dated lock for A: %v", err)
+	}
+	if err = repo.Backend().Remove(backend.Lock, oldID.String()); err != nil {
+		t.Fatalf("failed to remove A's original lock: %v", err)
+	}
+
+	if err = RemoveStaleLocks(repo); err != nil {
+		t.Fatalf("RemoveStaleLocks failed: %v", err)
+	}
+
+	// B now acquires an exclusive lock of its own, believing the repository
+	// to be unlocked.
+	lockB, err := NewExclusiveLock(repo)
+	if err != nil {
+		t.Fatalf("NewExclusiveLock for B failed: %v", err)
+	}
+	defer lockB.Unlock()
+
+	if lockB.Epoch <= lockA.Epoch {
+		t.Fatalf("expected B's epoch (%d) to be greater than A's (%d)", lockB.Epoch, lockA.Epoch)
+	}
+
+	// A wakes back up and checks its fencing token: it must be told it is
+	// no longer current.
+	if err = lockA.CheckFence(); err != ErrLockEpochStale {
+		t.Fatalf("expected CheckFence to report ErrLockEpochStale for the zombie writer, got %v", err)
+	}
+
+	// And trying to refresh the now-removed, now-superseded lock must
+	// refuse to write it back into existence.
+	if err = lockA.Refresh(); err != ErrLockSuperseded {
+		t.Fatalf("expected Refresh to report ErrLockSuperseded for the zombie writer, got %v", err)
+	}
+}
+
+// TestNonExclusiveRefreshRefusesToResurrect is the non-exclusive counterpart
+// to the zombie-writer half of TestLockZombieWriterFencing: an ordinary
+// backup's lock (no exclusive lock involved at all) must not be written
+// back into existence by Refresh once another process has judged it stale
+// and removed it.
+func TestNonExclusiveRefreshRefusesToResurrect(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	lock, err := NewLock(repo)
+	if err != nil {
+		t.Fatalf("NewLock failed: %v", err)
+	}
+
+	// Simulate the owner stalling long enough to be judged stale: replace
+	// its lock file with a back-dated copy, without going through Refresh.
+	lock.mu.Lock()
+	oldID := lock.lockID
+	lock.mu.Unlock()
+
+	stale := &Lock{
+		Time:            time.Now().Add(-2 * DefaultStaleTimeout),
+		Exclusive:       lock.Exclusive,
+		Hostname:        lock.Hostname,
+		Username:        lock.Username,
+		PID:             lock.PID,
+		UID:             lock.UID,
+		GID:             lock.GID,
+		Checker:         lock.Checker,
+		StaleTimeout:    lock.StaleTimeout,
+		RefreshInterval: lock.RefreshInterval,
+	}
+
+	if _, err = repo.SaveJSONUnpacked(backend.Lock, stale); err != nil {
+		t.Fatalf("failed to write back-dated lock: %v", err)
+	}
+	if err = repo.Backend().Remove(backend.Lock, oldID.String()); err != nil {
+		t.Fatalf("failed to remove original lock: %v", err)
+	}
+
+	if err = RemoveStaleLocks(repo); err != nil {
+		t.Fatalf("RemoveStaleLocks failed: %v", err)
+	}
+
+	// The owner wakes back up and tries to refresh its now-removed lock: it
+	// must refuse to write it back into existence.
+	if err = lock.Refresh(); err != ErrLockSuperseded {
+		t.Fatalf("expected Refresh to report ErrLockSuperseded, got %v", err)
+	}
+}
+
+// TestCurrentEpochSurvivesLockRemoval is a narrower regression test for the
+// bug fencing relies on not reoccurring: the epoch counter must not reset
+// just because no lock files happen to exist at scan time.
+func TestCurrentEpochSurvivesLockRemoval(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	epoch, err := CurrentEpoch(repo)
+	if err != nil {
+		t.Fatalf("CurrentEpoch failed: %v", err)
+	}
+	if epoch != 0 {
+		t.Fatalf("expected epoch 0 for a fresh repository, got %d", epoch)
+	}
+
+	lock, err := NewExclusiveLock(repo)
+	if err != nil {
+		t.Fatalf("NewExclusiveLock failed: %v", err)
+	}
+
+	if err = lock.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+
+	epoch, err = CurrentEpoch(repo)
+	if err != nil {
+		t.Fatalf("CurrentEpoch failed: %v", err)
+	}
+	if epoch != 1 {
+		t.Fatalf("expected epoch to remain 1 after the lock that obtained it was removed, got %d", epoch)
+	}
+}
+
+// TestBeaconStalenessPolicy checks that a lock using StalenessPolicyBeacon is
+// judged stale once its timestamp is older than a few refresh intervals,
+// even though it is still well within the stale timeout, and that a
+// recently beaconed lock is not.
+func TestBeaconStalenessPolicy(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	lock, err := NewExclusiveLockWithPolicy(repo, StalenessPolicyBeacon)
+	if err != nil {
+		t.Fatalf("NewExclusiveLockWithPolicy failed: %v", err)
+	}
+	defer lock.Unlock()
+
+	lock.Time = time.Now().Add(-20 * time.Minute)
+	if !lock.Stale() {
+		t.Fatalf("expected lock with a stale beacon to be reported stale")
+	}
+
+	lock.Time = time.Now()
+	if lock.Stale() {
+		t.Fatalf("expected freshly beaconed lock to not be stale")
+	}
+}
+
+// TestNewLockWithContextCancellation checks that NewExclusiveLockWithContext
+// gives up and returns ctx.Err() once ctx is done, instead of continuing to
+// retry against a conflicting lock that never goes away.
+func TestNewLockWithContextCancellation(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	holder, err := NewExclusiveLock(repo)
+	if err != nil {
+		t.Fatalf("NewExclusiveLock failed: %v", err)
+	}
+	defer holder.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = NewExclusiveLockWithContext(ctx, repo, LockRetryOptions{})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestNewLockWithContextMaxWait checks that NewExclusiveLockWithContext
+// gives up with ErrAlreadyLocked once MaxWait elapses, rather than retrying
+// forever against a conflicting lock that is never released.
+func TestNewLockWithContextMaxWait(t *testing.T) {
+	repo := repository.TestRepository(t)
+
+	holder, err := NewExclusiveLock(repo)
+	if err != nil {
+		t.Fatalf("NewExclusiveLock failed: %v", err)
+	}
+	defer holder.Unlock()
+
+	_, err = NewExclusiveLockWithContext(context.Background(), repo, LockRetryOptions{
+		MaxWait:        30 * time.Millisecond,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+	})
+	if err != ErrAlreadyLocked {
+		t.Fatalf("expected ErrAlreadyLocked once MaxWait elapsed, got %v", err)
+	}
+}